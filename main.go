@@ -1,5 +1,7 @@
 // Binary pprof-upload uploads a performance profile in pprof format to
-// Stackdriver Profiler UI for visualization.
+// Stackdriver Profiler UI for visualization. It can also run in a
+// scrape mode (see scrape.go) where it periodically collects profiles
+// from live /debug/pprof HTTP endpoints instead of reading files.
 package main
 
 import (
@@ -8,7 +10,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/pprof/profile"
@@ -18,11 +22,12 @@ import (
 )
 
 var (
-	projectID = flag.String("project_id", "", "cloud project ID where the profile will be uploaded (Required)")
-	service   = flag.String("service_name", "uploaded-profiles", "name of service for uploaded profiles")
-	version   = flag.String("service_version", "", "version of service for uploaded profiles")
-	apiAddr   = flag.String("api_addr", "cloudprofiler.googleapis.com:443", "profiler API address")
-	merge     = flag.Bool("merge", true, "when false, upload individual profiles")
+	projectID   = flag.String("project_id", "", "cloud project ID where the profile will be uploaded (Required)")
+	service     = flag.String("service_name", "uploaded-profiles", "name of service for uploaded profiles")
+	version     = flag.String("service_version", "", "version of service for uploaded profiles")
+	apiAddr     = flag.String("api_addr", "cloudprofiler.googleapis.com:443", "profiler API address")
+	merge       = flag.Bool("merge", true, "when false, upload individual profiles")
+	profileType = flag.String("profile_type", "", "profile type to upload as (e.g. CPU, HEAP, HEAP_ALLOC, CONTENTION, THREADS); overrides auto-detection from the profile's sample types")
 )
 
 // readProfiles reads profile files in pprof format at specified paths.
@@ -46,8 +51,12 @@ func readProfiles(fnames []string) ([]*profile.Profile, error) {
 
 const scope = "https://www.googleapis.com/auth/monitoring.write"
 
-// uploadProfile uploads the specified profile to Stackdriver Profiler.
+// uploadProfile uploads the specified profile to Stackdriver Profiler. The
+// profile is symbolized in place first (see symbolizeProfile).
+// Deployment.Labels always include the version label and, when running on
+// GCE/GKE, the labels returned by gceLabels.
 func uploadProfile(ctx context.Context, p *profile.Profile, service, version string) error {
+	symbolizeProfile(p)
 	pt, err := guessType(p)
 	if err != nil {
 		return err
@@ -64,6 +73,12 @@ func uploadProfile(ctx context.Context, p *profile.Profile, service, version str
 	if err != nil {
 		return err
 	}
+	labels := map[string]string{
+		"version": version,
+	}
+	for k, v := range gceLabels() {
+		labels[k] = v
+	}
 	client := pb.NewProfilerServiceClient(conn)
 	req := pb.CreateOfflineProfileRequest{
 		Parent: "projects/" + *projectID,
@@ -72,23 +87,35 @@ func uploadProfile(ctx context.Context, p *profile.Profile, service, version str
 			Deployment: &pb.Deployment{
 				ProjectId: *projectID,
 				Target:    service,
-				Labels: map[string]string{
-					"version": version,
-				},
+				Labels:    labels,
 			},
 			ProfileBytes: bb.Bytes(),
 		},
 	}
-	_, err = client.CreateOfflineProfile(ctx, &req)
-	if err != nil {
+	if err := createOfflineProfile(ctx, client, &req); err != nil {
 		return err
 	}
 	return nil
 }
 
+// guessType returns the Cloud Profiler profile type to upload the profile
+// as. If -profile_type is set, it is used verbatim (case-insensitively);
+// otherwise the type is guessed from the profile's sample types.
 func guessType(p *profile.Profile) (pb.ProfileType, error) {
+	if *profileType != "" {
+		pt, ok := pb.ProfileType_value[strings.ToUpper(*profileType)]
+		if !ok {
+			return pb.ProfileType_PROFILE_TYPE_UNSPECIFIED, fmt.Errorf("invalid -profile_type %q", *profileType)
+		}
+		return pb.ProfileType(pt), nil
+	}
+	// A heap profile carries both inuse_* and alloc_* sample types; prefer
+	// inuse_* (the UI default, and what this uploader has always reported)
+	// so existing heap profiles don't silently reclassify as HEAP_ALLOC.
 	var types []string
+	var sawAlloc, sawContention, sawGoroutine bool
 	for _, st := range p.SampleType {
+		types = append(types, st.Type)
 		switch st.Type {
 		case "cpu":
 			return pb.ProfileType_CPU, nil
@@ -96,21 +123,51 @@ func guessType(p *profile.Profile) (pb.ProfileType, error) {
 			return pb.ProfileType_WALL, nil
 		case "space", "inuse_space":
 			return pb.ProfileType_HEAP, nil
+		case "alloc_space", "alloc_objects":
+			sawAlloc = true
+		case "contentions", "delay":
+			sawContention = true
+		case "goroutine", "goroutines":
+			sawGoroutine = true
 		}
-		types = append(types, st.Type)
 	}
-	return pb.ProfileType_PROFILE_TYPE_UNSPECIFIED, fmt.Errorf("failed to guess profile type from sample types %v", types)
+	switch {
+	case sawAlloc:
+		return pb.ProfileType_HEAP_ALLOC, nil
+	case sawContention:
+		return pb.ProfileType_CONTENTION, nil
+	case sawGoroutine:
+		return pb.ProfileType_THREADS, nil
+	}
+	return pb.ProfileType_PROFILE_TYPE_UNSPECIFIED, fmt.Errorf("failed to guess profile type from sample types %v; use -profile_type to force it", types)
 }
 
 func main() {
 	flag.Parse()
 
-	if *projectID == "" || len(flag.Args()) == 0 {
+	if *projectID == "" {
+		// Fall back to the project of the GCE/GKE instance this binary is
+		// running on, if any.
+		*projectID = gceProjectID()
+	}
+
+	if *projectID == "" || (len(flag.Args()) == 0 && len(scrapeEndpoints) == 0) {
 		fmt.Fprintln(os.Stderr, "Usage: pprof-upload -project_id=PROJECT_ID FILE...")
+		fmt.Fprintln(os.Stderr, "   or: pprof-upload -project_id=PROJECT_ID -scrape_endpoint=http://host:port/debug/pprof [-scrape_endpoint=...]")
 		flag.PrintDefaults()
 		os.Exit(2)
 	}
 
+	if len(scrapeEndpoints) > 0 {
+		// Stop scraping on SIGINT/SIGTERM by canceling ctx, so that runScrape
+		// returns instead of the process being killed. Canceling ctx also
+		// aborts any in-flight fetch or upload.
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		runScrape(ctx)
+		return
+	}
+
 	ps, err := readProfiles(flag.Args())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+)
+
+var (
+	gceLabelsOnce   sync.Once
+	cachedGCELabels map[string]string
+)
+
+// gceLabels returns Deployment.Labels populated from GCE/GKE metadata: the
+// zone and instance name from the metadata server, and, when running in a
+// pod, the cluster name from the metadata server plus the pod and
+// container name from the Kubernetes downward API environment variables.
+// It returns nil when not running on GCE. The metadata server is only
+// queried once per process; the result is cached for subsequent calls,
+// since it cannot change while the binary is running.
+func gceLabels() map[string]string {
+	gceLabelsOnce.Do(func() {
+		cachedGCELabels = fetchGCELabels()
+	})
+	return cachedGCELabels
+}
+
+func fetchGCELabels() map[string]string {
+	if !metadata.OnGCE() {
+		return nil
+	}
+	labels := make(map[string]string)
+	if zone, err := metadata.Zone(); err == nil && zone != "" {
+		labels["zone"] = zone
+	}
+	if instance, err := metadata.InstanceName(); err == nil && instance != "" {
+		labels["instance"] = instance
+	}
+	if cluster, err := metadata.InstanceAttributeValue("cluster-name"); err == nil && cluster != "" {
+		labels["cluster_name"] = cluster
+	}
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		labels["pod_name"] = pod
+	}
+	if container := os.Getenv("CONTAINER_NAME"); container != "" {
+		labels["container_name"] = container
+	}
+	return labels
+}
+
+// gceProjectID returns the project ID of the GCE instance this binary is
+// running on, or "" if not running on GCE.
+func gceProjectID() string {
+	if !metadata.OnGCE() {
+		return ""
+	}
+	id, _ := metadata.ProjectID()
+	return id
+}
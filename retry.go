@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	pb "google.golang.org/genproto/googleapis/devtools/cloudprofiler/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	maxUploadAttempts = 10
+	initialRetryDelay = time.Second
+	maxRetryDelay     = 60 * time.Second
+)
+
+// retryableCodes are the gRPC status codes treated as transient for
+// CreateOfflineProfile, matching what the Cloud Profiler agent retries on.
+var retryableCodes = map[codes.Code]bool{
+	codes.Unavailable:       true,
+	codes.DeadlineExceeded:  true,
+	codes.Internal:          true,
+	codes.ResourceExhausted: true,
+}
+
+// createOfflineProfile calls CreateOfflineProfile, retrying transient
+// errors with exponential backoff (doubling from initialRetryDelay up to
+// maxRetryDelay, up to maxUploadAttempts total attempts). On an ABORTED
+// response it uses the server-requested delay from the
+// google.rpc.RetryInfo error detail, if present, instead of the computed
+// backoff. Either delay is then extended by a random jitter of up to 50%,
+// so a single wait can exceed maxRetryDelay.
+func createOfflineProfile(ctx context.Context, client pb.ProfilerServiceClient, req *pb.CreateOfflineProfileRequest) error {
+	delay := initialRetryDelay
+	var err error
+	for attempt := 1; attempt <= maxUploadAttempts; attempt++ {
+		_, err = client.CreateOfflineProfile(ctx, req)
+		if err == nil {
+			return nil
+		}
+		st, ok := status.FromError(err)
+		if !ok {
+			return err
+		}
+		wait := delay
+		if st.Code() == codes.Aborted {
+			if d, ok := retryInfoDelay(st); ok {
+				wait = d
+			}
+		} else if !retryableCodes[st.Code()] {
+			return err
+		}
+		if attempt == maxUploadAttempts {
+			break
+		}
+		wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		fmt.Fprintf(os.Stderr, "Upload failed (%v), retrying in %v (attempt %d/%d)...\n", err, wait, attempt, maxUploadAttempts)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+	return fmt.Errorf("failed to upload profile after %d attempts: %v", maxUploadAttempts, err)
+}
+
+// retryInfoDelay extracts the retry delay requested by the server from a
+// google.rpc.RetryInfo detail attached to st, if any.
+func retryInfoDelay(st *status.Status) (time.Duration, bool) {
+	for _, d := range st.Details() {
+		if ri, ok := d.(*errdetails.RetryInfo); ok && ri.RetryDelay != nil {
+			return ri.RetryDelay.AsDuration(), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// endpointList accumulates the values of a repeatable flag.
+type endpointList []string
+
+func (e *endpointList) String() string { return strings.Join(*e, ",") }
+
+func (e *endpointList) Set(v string) error {
+	*e = append(*e, v)
+	return nil
+}
+
+var (
+	scrapeEndpoints endpointList
+	scrapeInterval  = flag.Duration("scrape_interval", time.Minute, "how often to scrape and upload profiles in -scrape_endpoint mode")
+	scrapeDuration  = flag.Duration("scrape_duration", 10*time.Second, "duration of the CPU profile collected on each scrape, passed to the endpoint as ?seconds=N")
+	outDir          = flag.String("out_dir", "", "if set, also write each merged profile collected in -scrape_endpoint mode to this directory")
+)
+
+func init() {
+	flag.Var(&scrapeEndpoints, "scrape_endpoint", "base URL of a /debug/pprof HTTP endpoint to scrape (e.g. http://host:port/debug/pprof); repeat to scrape a fleet")
+}
+
+// scrapeKinds are the /debug/pprof handler path segments collected on each
+// scrape, in the order they are fetched and uploaded.
+var scrapeKinds = []string{"profile", "heap", "mutex", "goroutine"}
+
+// fetchTimeout bounds how long fetchProfile waits for a non-CPU endpoint
+// (heap, mutex, goroutine) to respond, so one unresponsive host can't
+// stall the whole scrape.
+const fetchTimeout = 10 * time.Second
+
+// fetchSlack is added on top of -scrape_duration to bound how long
+// fetchProfile waits for the CPU endpoint, which is expected to take at
+// least that long to respond.
+const fetchSlack = 10 * time.Second
+
+// fetchProfile fetches and parses a single profile of the given kind (e.g.
+// "profile", "heap") from the /debug/pprof endpoint rooted at base. The
+// fetch is bounded so that an endpoint which accepts the connection but
+// never responds doesn't hang the scrape indefinitely.
+func fetchProfile(ctx context.Context, base, kind string) (*profile.Profile, error) {
+	u := strings.TrimRight(base, "/") + "/" + kind
+	timeout := fetchTimeout
+	if kind == "profile" {
+		u += fmt.Sprintf("?seconds=%d", int(scrapeDuration.Seconds()))
+		timeout = *scrapeDuration + fetchSlack
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape %s: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to scrape %s: status %s", u, resp.Status)
+	}
+	p, err := profile.Parse(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse profile scraped from %s: %v", u, err)
+	}
+	return p, nil
+}
+
+// tagSamplesWithEndpoint attaches an "endpoint" pprof label carrying
+// endpoint to every sample in p, so that samples remain attributable to
+// their source host after p is merged with profiles from other endpoints.
+func tagSamplesWithEndpoint(p *profile.Profile, endpoint string) {
+	for _, s := range p.Sample {
+		if s.Label == nil {
+			s.Label = make(map[string][]string)
+		}
+		s.Label["endpoint"] = []string{endpoint}
+	}
+}
+
+// scrapeKind concurrently fetches profiles of the given kind from all
+// configured endpoints, tags each one's samples with the endpoint's
+// host:port, and merges them.
+func scrapeKind(ctx context.Context, kind string) (*profile.Profile, []string, error) {
+	ps := make([]*profile.Profile, len(scrapeEndpoints))
+	hosts := make([]string, len(scrapeEndpoints))
+	var wg sync.WaitGroup
+	for i, base := range scrapeEndpoints {
+		wg.Add(1)
+		go func(i int, base string) {
+			defer wg.Done()
+			p, err := fetchProfile(ctx, base, kind)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				return
+			}
+			host := base
+			if u, err := url.Parse(base); err == nil && u.Host != "" {
+				host = u.Host
+			}
+			tagSamplesWithEndpoint(p, host)
+			ps[i] = p
+			hosts[i] = host
+		}(i, base)
+	}
+	wg.Wait()
+
+	var merged []*profile.Profile
+	var mergedHosts []string
+	for i, p := range ps {
+		if p == nil {
+			continue
+		}
+		merged = append(merged, p)
+		mergedHosts = append(mergedHosts, hosts[i])
+	}
+	if len(merged) == 0 {
+		return nil, nil, fmt.Errorf("no endpoints returned a %s profile", kind)
+	}
+	p, err := profile.Merge(merged)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to merge %s profiles: %v", kind, err)
+	}
+	return p, mergedHosts, nil
+}
+
+// writeProfile persists p to -out_dir for local use (e.g. PGO).
+func writeProfile(p *profile.Profile, kind string) error {
+	fname := filepath.Join(*outDir, fmt.Sprintf("%s-%d.pb.gz", kind, time.Now().UnixNano()))
+	f, err := os.Create(fname)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", fname, err)
+	}
+	defer f.Close()
+	if err := p.Write(f); err != nil {
+		return fmt.Errorf("failed to write %s: %v", fname, err)
+	}
+	return nil
+}
+
+// scrapeOnce scrapes and uploads one merged profile per entry in
+// scrapeKinds.
+func scrapeOnce(ctx context.Context) {
+	for _, kind := range scrapeKinds {
+		p, hosts, err := scrapeKind(ctx, kind)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+		p.TimeNanos = time.Now().UnixNano()
+
+		if *outDir != "" {
+			if err := writeProfile(p, kind); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}
+
+		if err := uploadProfile(ctx, p, *service, *version); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to upload %s profile: %v\n", kind, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "Uploaded merged %s profile from %d endpoint(s)\n", kind, len(hosts))
+	}
+}
+
+// runScrape scrapes the configured endpoints immediately and then every
+// -scrape_interval, uploading a merged profile per kind on each pass. It
+// runs until ctx is canceled.
+func runScrape(ctx context.Context) {
+	scrapeOnce(ctx)
+	ticker := time.NewTicker(*scrapeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			scrapeOnce(ctx)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"debug/elf"
+	"debug/gosym"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// binaryList accumulates the values of a repeatable flag.
+type binaryList []string
+
+func (b *binaryList) String() string { return strings.Join(*b, ",") }
+
+func (b *binaryList) Set(v string) error {
+	*b = append(*b, v)
+	return nil
+}
+
+var (
+	binaries  binaryList
+	symbolize = flag.String("symbolize", "local", "symbolization of profile mappings without function info, using -binary: none, local, or force (re-symbolize mappings that already have function info)")
+)
+
+func init() {
+	flag.Var(&binaries, "binary", "path to a local ELF binary to symbolize profiles with (repeatable; Mach-O binaries are not supported); matched to a profile's mappings by build ID, or by file name when no binary's build ID matches the mapping")
+}
+
+// symbolizeProfile resolves addresses in p's mappings that lack function
+// info (or, with -symbolize=force, all mappings) using the binaries given
+// via -binary, matching each mapping to a binary by build ID or, failing
+// that, by file name. It is a no-op when -symbolize=none or no binaries
+// were given.
+func symbolizeProfile(p *profile.Profile) {
+	if *symbolize == "none" || len(binaries) == 0 {
+		return
+	}
+	force := *symbolize == "force"
+	byBuildID, byName := indexBinaries(binaries)
+	for _, m := range p.Mapping {
+		if m.HasFunctions && !force {
+			continue
+		}
+		bin := byBuildID[m.BuildID]
+		if bin == "" {
+			bin = byName[filepath.Base(m.File)]
+		}
+		if bin == "" {
+			continue
+		}
+		if err := symbolizeMapping(p, m, bin); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: failed to symbolize %s: %v\n", m.File, err)
+			continue
+		}
+		m.HasFunctions = true
+	}
+}
+
+// indexBinaries reads the build ID of each binary in paths and returns it
+// indexed both by build ID and by base file name, for matching against
+// profile mappings.
+func indexBinaries(paths []string) (byBuildID, byName map[string]string) {
+	byBuildID = make(map[string]string)
+	byName = make(map[string]string)
+	for _, path := range paths {
+		byName[filepath.Base(path)] = path
+		if id, err := elfBuildID(path); err == nil && id != "" {
+			byBuildID[id] = path
+		}
+	}
+	return byBuildID, byName
+}
+
+// elfSym is a function symbol from a binary's ELF symbol table.
+type elfSym struct {
+	addr uint64
+	size uint64
+	name string
+}
+
+// symbolizeMapping resolves the Location and Line entries of all of p's
+// locations that fall within m, using the symbol table (and, for Go
+// binaries, the pcline table) of the binary at path. Locations that already
+// have line info are left as they are unless -symbolize=force. It returns an error,
+// and leaves every Location untouched, if no address could be resolved to
+// a symbol (e.g. the binary is stripped and isn't a Go binary).
+func symbolizeMapping(p *profile.Profile, m *profile.Mapping, path string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// m.Offset is the file offset the mapping was loaded from; translate
+	// it to the ELF virtual address space via the covering PT_LOAD
+	// segment so it lines up with the addresses in the symbol and pcline
+	// tables below (which are all virtual addresses).
+	bias, ok := elfLoadBias(f, m.Offset)
+	if !ok {
+		return fmt.Errorf("no PT_LOAD segment covers file offset %#x", m.Offset)
+	}
+
+	syms, err := textSymbols(f)
+	if err != nil {
+		return err
+	}
+	tab := goSymTable(f)
+
+	funcs := make(map[string]*profile.Function, len(p.Function))
+	var maxFuncID uint64
+	for _, fn := range p.Function {
+		funcs[fn.Name] = fn
+		if fn.ID > maxFuncID {
+			maxFuncID = fn.ID
+		}
+	}
+
+	var resolved int
+	for _, loc := range p.Location {
+		if loc.Mapping != m || (len(loc.Line) > 0 && *symbolize != "force") {
+			continue
+		}
+		addr := loc.Address - m.Start + m.Offset + bias
+		name, file, line := lookup(tab, syms, addr)
+		if name == "" {
+			continue
+		}
+		fn, ok := funcs[name]
+		if !ok {
+			maxFuncID++
+			fn = &profile.Function{ID: maxFuncID, Name: name, SystemName: name, Filename: file}
+			funcs[name] = fn
+			p.Function = append(p.Function, fn)
+		}
+		loc.Line = []profile.Line{{Function: fn, Line: int64(line)}}
+		resolved++
+	}
+	if resolved == 0 {
+		return fmt.Errorf("no addresses in mapping resolved to a symbol in %s", path)
+	}
+	return nil
+}
+
+// elfLoadBias returns the bias to add to a file offset within f to get the
+// corresponding ELF virtual address, derived from the PT_LOAD segment
+// whose file range covers fileOffset. It returns ok=false if no PT_LOAD
+// segment covers fileOffset.
+func elfLoadBias(f *elf.File, fileOffset uint64) (bias uint64, ok bool) {
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		if fileOffset >= prog.Off && fileOffset < prog.Off+prog.Filesz {
+			return prog.Vaddr - prog.Off, true
+		}
+	}
+	return 0, false
+}
+
+// textSymbols returns f's defined function symbols, sorted by address,
+// for nearest-address lookup. It returns a nil slice, not an error, if f
+// has no regular symbol table (e.g. it is stripped).
+func textSymbols(f *elf.File) ([]elfSym, error) {
+	elfSyms, err := f.Symbols()
+	if err != nil {
+		return nil, nil
+	}
+	var syms []elfSym
+	for _, s := range elfSyms {
+		if elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Name == "" {
+			continue
+		}
+		syms = append(syms, elfSym{addr: s.Value, size: s.Size, name: s.Name})
+	}
+	sort.Slice(syms, func(i, j int) bool { return syms[i].addr < syms[j].addr })
+	return syms, nil
+}
+
+// nearestSymbol returns the name of the function symbol containing addr,
+// or "" if none is found.
+func nearestSymbol(syms []elfSym, addr uint64) string {
+	i := sort.Search(len(syms), func(i int) bool { return syms[i].addr > addr })
+	if i == 0 {
+		return ""
+	}
+	s := syms[i-1]
+	if s.size != 0 && addr >= s.addr+s.size {
+		return ""
+	}
+	return s.name
+}
+
+// goSymTable builds a debug/gosym table from f's .gopclntab/.gosymtab
+// sections, for resolving Go function names and file/line info. It
+// returns nil if f does not look like a Go binary.
+func goSymTable(f *elf.File) *gosym.Table {
+	textSec := f.Section(".text")
+	pclntabSec := f.Section(".gopclntab")
+	if textSec == nil || pclntabSec == nil {
+		return nil
+	}
+	pclntab, err := pclntabSec.Data()
+	if err != nil {
+		return nil
+	}
+	var symtab []byte
+	if s := f.Section(".gosymtab"); s != nil {
+		symtab, _ = s.Data()
+	}
+	lineTable := gosym.NewLineTable(pclntab, textSec.Addr)
+	tab, err := gosym.NewTable(symtab, lineTable)
+	if err != nil {
+		return nil
+	}
+	return tab
+}
+
+// lookup resolves addr to a function name, source file, and line number,
+// preferring tab (Go pcline info) and falling back to the nearest symbol
+// in syms.
+func lookup(tab *gosym.Table, syms []elfSym, addr uint64) (name, file string, line int) {
+	if tab != nil {
+		if fn := tab.PCToFunc(addr); fn != nil {
+			file, line, _ = tab.PCToLine(addr)
+			return fn.Name, file, line
+		}
+	}
+	return nearestSymbol(syms, addr), "", 0
+}
+
+// elfBuildID returns the hex-encoded ELF build ID of the binary at path,
+// or "" if it has none.
+func elfBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sec := f.Section(".note.gnu.build-id")
+	if sec == nil {
+		return "", nil
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return "", err
+	}
+	return parseBuildIDNote(data), nil
+}
+
+// parseBuildIDNote extracts the build ID from the contents of a
+// .note.gnu.build-id ELF note section (name size, descriptor size, type,
+// name, descriptor, per the ELF note format; the build ID is the
+// descriptor).
+func parseBuildIDNote(data []byte) string {
+	if len(data) < 12 {
+		return ""
+	}
+	nameSize := binary.LittleEndian.Uint32(data[0:4])
+	descSize := binary.LittleEndian.Uint32(data[4:8])
+	descStart := 12 + align4(nameSize)
+	descEnd := descStart + descSize
+	if descEnd > uint32(len(data)) {
+		return ""
+	}
+	return hex.EncodeToString(data[descStart:descEnd])
+}
+
+// align4 rounds n up to the nearest multiple of 4.
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}